@@ -0,0 +1,114 @@
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+)
+
+// BackingChainError reports a problem found while walking a candidate
+// backing file's ancestor chain, such as a cycle or an unsafe overlay.
+type BackingChainError struct {
+	Path   string // Candidate backing file that failed validation
+	Reason string // Human readable description of the failure
+}
+
+func (e *BackingChainError) Error() string {
+	return fmt.Sprintf("backing chain validation failed for %q: %s", e.Path, e.Reason)
+}
+
+// backingChainLink mirrors a single entry of 'qemu-img info --backing-chain --output=json'
+type backingChainLink struct {
+	Filename            string `json:"filename"`
+	FullBackingFilename string `json:"full-backing-filename,omitempty"`
+}
+
+// maxBackingChainDepth returns the configured depth limit for i, falling
+// back to DefaultMaxBackingChainDepth when unset.
+func (i Image) maxBackingChainDepth() int {
+	if i.MaxBackingChainDepth > 0 {
+		return i.MaxBackingChainDepth
+	}
+	return DefaultMaxBackingChainDepth
+}
+
+// ValidateBackingChain inspects the backing file chain of candidate and
+// rejects it if the candidate is itself a differential (overlay) disk,
+// if the chain would cycle back to the image's own path or revisit any
+// entry, or if the chain is deeper than the image's MaxBackingChainDepth.
+// Rejecting overlay candidates closes a real vulnerability: without it, a
+// caller can be tricked into rebasing onto an attacker-controlled overlay
+// whose own backing file points at an arbitrary host path. It can be
+// called standalone to vet a backing file before it is wired into an
+// image.
+func (i Image) ValidateBackingChain(candidate string) error {
+	return i.ValidateBackingChainContext(context.Background(), candidate)
+}
+
+// ValidateBackingChainContext is ValidateBackingChain with ctx
+// controlling cancellation of the underlying qemu-img process.
+func (i Image) ValidateBackingChainContext(ctx context.Context, candidate string) error {
+	out, err := runQemuImgContext(ctx, "qemu-img info --backing-chain", candidate, "info", "--backing-chain", "--output=json", candidate)
+	if err != nil {
+		return err
+	}
+
+	var chain []backingChainLink
+	if err := json.Unmarshal(out, &chain); err != nil {
+		return fmt.Errorf("'qemu-img info --backing-chain' invalid json output")
+	}
+
+	if len(chain) == 0 {
+		return nil
+	}
+
+	if chain[0].FullBackingFilename != "" {
+		return &BackingChainError{Path: candidate, Reason: "candidate backing file is itself a differential (overlay) disk"}
+	}
+
+	selfAbs, err := canonicalPath(i.Path)
+	if err != nil {
+		return fmt.Errorf("resolving image path %q: %w", i.Path, err)
+	}
+
+	depth := i.maxBackingChainDepth()
+	seen := make(map[string]bool, len(chain))
+	for idx, link := range chain {
+		if idx >= depth {
+			return &BackingChainError{Path: candidate, Reason: fmt.Sprintf("backing chain exceeds maximum depth of %d", depth)}
+		}
+
+		abs, err := canonicalPath(link.Filename)
+		if err != nil {
+			return fmt.Errorf("resolving backing chain entry %q: %w", link.Filename, err)
+		}
+
+		if abs == selfAbs {
+			return &BackingChainError{Path: candidate, Reason: "backing chain introduces a cycle back to the image itself"}
+		}
+		if seen[abs] {
+			return &BackingChainError{Path: candidate, Reason: fmt.Sprintf("backing chain revisits %q", link.Filename)}
+		}
+		seen[abs] = true
+	}
+
+	return nil
+}
+
+// canonicalPath resolves path to an absolute, symlink-free form so that
+// two different spellings of the same file compare equal. If the file
+// does not exist yet, the absolute path is returned as-is.
+func canonicalPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return abs, nil
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,131 @@
+package qemu
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFakeQemuImg installs a fake "qemu-img" on PATH (scoped to the test)
+// that answers "info --backing-chain --output=json <path>" by cat'ing
+// "<path>.json", so ValidateBackingChainContext can be exercised against
+// canned backing-chain fixtures without a real qemu-img binary or disk
+// images on hand.
+func writeFakeQemuImg(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	script := "#!/bin/bash\ncat \"${@: -1}.json\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "qemu-img"), []byte(script), 0o755); err != nil {
+		t.Fatalf("writing fake qemu-img: %v", err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return dir
+}
+
+// writeChainFixture records the JSON qemu-img info --backing-chain would
+// report for candidate.
+func writeChainFixture(t *testing.T, candidate, json string) {
+	t.Helper()
+
+	if err := os.WriteFile(candidate+".json", []byte(json), 0o644); err != nil {
+		t.Fatalf("writing chain fixture for %q: %v", candidate, err)
+	}
+}
+
+func TestValidateBackingChainContext(t *testing.T) {
+	dir := writeFakeQemuImg(t)
+	self := filepath.Join(dir, "self.qcow2")
+	img := NewImage(self, ImageFormatQCOW2, 0)
+
+	tests := []struct {
+		name      string
+		chain     string
+		wantErr   bool
+		wantMatch string
+	}{
+		{
+			name:    "no backing file",
+			chain:   `[]`,
+			wantErr: false,
+		},
+		{
+			name:      "candidate is itself an overlay",
+			chain:     `[{"filename":"` + filepath.Join(dir, "candidate.qcow2") + `","full-backing-filename":"` + filepath.Join(dir, "base.qcow2") + `"}]`,
+			wantErr:   true,
+			wantMatch: "itself a differential (overlay) disk",
+		},
+		{
+			name: "chain cycles back to the image itself",
+			chain: `[{"filename":"` + filepath.Join(dir, "base.qcow2") + `"},` +
+				`{"filename":"` + self + `"}]`,
+			wantErr:   true,
+			wantMatch: "introduces a cycle",
+		},
+		{
+			name: "chain revisits an entry",
+			chain: `[{"filename":"` + filepath.Join(dir, "shared.qcow2") + `"},` +
+				`{"filename":"` + filepath.Join(dir, "mid.qcow2") + `"},` +
+				`{"filename":"` + filepath.Join(dir, "shared.qcow2") + `"}]`,
+			wantErr:   true,
+			wantMatch: "revisits",
+		},
+		{
+			name:    "valid single-hop chain",
+			chain:   `[{"filename":"` + filepath.Join(dir, "base.qcow2") + `"}]`,
+			wantErr: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidate := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "_")+".qcow2")
+			writeChainFixture(t, candidate, tt.chain)
+
+			err := img.ValidateBackingChainContext(context.Background(), candidate)
+			if tt.wantErr {
+				var bce *BackingChainError
+				if !errors.As(err, &bce) {
+					t.Fatalf("got err %v, want a *BackingChainError", err)
+				}
+				if !strings.Contains(bce.Reason, tt.wantMatch) {
+					t.Fatalf("got reason %q, want it to contain %q", bce.Reason, tt.wantMatch)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got unexpected err %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateBackingChainContextMaxDepth(t *testing.T) {
+	dir := writeFakeQemuImg(t)
+	img := NewImage(filepath.Join(dir, "self.qcow2"), ImageFormatQCOW2, 0)
+	img.MaxBackingChainDepth = 2
+
+	var links []string
+	for i := 0; i < 3; i++ {
+		links = append(links, `{"filename":"`+filepath.Join(dir, "link"+strings.Repeat("x", i+1)+".qcow2")+`"}`)
+	}
+	chain := "[" + strings.Join(links, ",") + "]"
+
+	candidate := filepath.Join(dir, "deep.qcow2")
+	writeChainFixture(t, candidate, chain)
+
+	err := img.ValidateBackingChainContext(context.Background(), candidate)
+
+	var bce *BackingChainError
+	if !errors.As(err, &bce) {
+		t.Fatalf("got err %v, want a *BackingChainError", err)
+	}
+	if !strings.Contains(bce.Reason, "exceeds maximum depth") {
+		t.Fatalf("got reason %q, want it to mention exceeding max depth", bce.Reason)
+	}
+}
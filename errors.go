@@ -0,0 +1,81 @@
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sentinel errors qemu-img/qemu-nbd failures are classified into, so
+// callers can distinguish them with errors.Is instead of parsing Stderr.
+var (
+	ErrEncryptedNoSecret  = errors.New("image is encrypted but no secret was provided")
+	ErrWrongSecret        = errors.New("incorrect secret for encrypted image")
+	ErrBackingFileMissing = errors.New("backing file does not exist or could not be opened")
+	ErrSnapshotNotFound   = errors.New("snapshot not found")
+	ErrFormatUnsupported  = errors.New("unsupported image format")
+)
+
+// Error wraps a failed qemu-img/qemu-nbd invocation with enough
+// structure for callers to match specific failures with errors.Is/As,
+// instead of pattern-matching Stderr themselves.
+type Error struct {
+	Op       string // Operation that failed, e.g. "qemu-img create"
+	Path     string // Image path the operation was acting on
+	Stderr   string // Captured process output, truncated to a bounded size
+	ExitCode int    // Process exit code, or -1 if the process never ran
+	Err      error  // Wrapped sentinel error, or the raw process error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %q: %s", e.Op, e.Path, e.Stderr)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// classifyError builds an *Error for a failed qemu-img/qemu-nbd
+// invocation, matching known output patterns against the package's
+// sentinel errors so callers can use errors.Is.
+func classifyError(op, path string, out []byte, procErr error) error {
+	qerr := &Error{
+		Op:       op,
+		Path:     path,
+		Stderr:   oneLine(out),
+		ExitCode: exitCodeOf(procErr),
+		Err:      procErr,
+	}
+
+	text := strings.ToLower(string(out))
+	switch {
+	case strings.Contains(text, "invalid password") ||
+		strings.Contains(text, "decryption failed") ||
+		strings.Contains(text, "wrong key"):
+		qerr.Err = ErrWrongSecret
+	case strings.Contains(text, "missing secret") ||
+		strings.Contains(text, "--object secret") ||
+		(strings.Contains(text, "encrypted") && strings.Contains(text, "secret")):
+		qerr.Err = ErrEncryptedNoSecret
+	case strings.Contains(text, "could not open backing file") ||
+		(strings.Contains(text, "backing") && strings.Contains(text, "no such file or directory")):
+		qerr.Err = ErrBackingFileMissing
+	case strings.Contains(text, "snapshot") &&
+		(strings.Contains(text, "not found") || strings.Contains(text, "does not exist")):
+		qerr.Err = ErrSnapshotNotFound
+	case strings.Contains(text, "unknown file format") ||
+		strings.Contains(text, "unknown driver") ||
+		strings.Contains(text, "unsupported format"):
+		qerr.Err = ErrFormatUnsupported
+	}
+
+	return qerr
+}
+
+func exitCodeOf(err error) int {
+	type exitCoder interface{ ExitCode() int }
+	if ec, ok := err.(exitCoder); ok {
+		return ec.ExitCode()
+	}
+	return -1
+}
@@ -1,10 +1,10 @@
 package qemu
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"strconv"
 	"time"
 )
@@ -34,30 +34,41 @@ const (
 	CipherModeXTS             = "xts"
 	IVGenAlgPlain64           = "plain64"
 	IVGenHashAlgorithmSHA256  = "sha256"
+
+	// DefaultMaxBackingChainDepth is the maximum number of backing file
+	// hops ValidateBackingChain will follow before refusing a chain as
+	// too deep, when Image.MaxBackingChainDepth is left at zero.
+	DefaultMaxBackingChainDepth = 16
 )
 
 // Image represents a QEMU disk image
 type Image struct {
-	Path                string     // Image location (filepath)
-	Format              string     // Image format
-	Size                uint64     // Image size in bytes
-	Secret              string     // Image secret, this enables encryption
-	BackingFile         string     // Image backing file (filepath)
-	Encrypted           bool       // Image encryption value (readonly)
-	LazyRefcounts       bool       // Image lazy refcount value
-	CompatLevel         string     // Image compatibility level
-	RefcountBits        int64      // Image refcount bits
-	ClusterSizeKB       int64      // Image cluster size (bytes)
-	ExtendedL2          bool       // Image L2 table extension value
-	Preallocation       string     // Image preallocation type
-	CipherAlgorithm     string     // Image encryption cipher algorithm
-	CipherMode          string     // Image encryption cipher mode
-	CipherFormat        string     // Image encryption cipher format
-	CipherHashAlg       string     // Image encryption cipher hash algorithm
-	EncryptIterTime     int64      // Image encryption PBKDF iteration time (ms)
-	EncryptIvGenAlg     string     // Image encryption IV generation algorithm
-	EncryptIvGenHashAlg string     // Image encryption IV generation hash algorithm
-	snapshots           []Snapshot // Image snapshot array
+	Path                 string                // Image location (filepath)
+	Format               string                // Image format
+	Size                 uint64                // Image size in bytes
+	Secret               string                // Image secret, this enables encryption
+	BackingFile          string                // Image backing file (filepath)
+	Encrypted            bool                  // Image encryption value (readonly)
+	LazyRefcounts        bool                  // Image lazy refcount value
+	CompatLevel          string                // Image compatibility level
+	RefcountBits         int64                 // Image refcount bits
+	ClusterSizeKB        int64                 // Image cluster size (bytes)
+	ExtendedL2           bool                  // Image L2 table extension value
+	Preallocation        string                // Image preallocation type
+	CipherAlgorithm      string                // Image encryption cipher algorithm
+	CipherMode           string                // Image encryption cipher mode
+	CipherFormat         string                // Image encryption cipher format
+	CipherHashAlg        string                // Image encryption cipher hash algorithm
+	EncryptIterTime      int64                 // Image encryption PBKDF iteration time (ms)
+	EncryptIvGenAlg      string                // Image encryption IV generation algorithm
+	EncryptIvGenHashAlg  string                // Image encryption IV generation hash algorithm
+	MaxBackingChainDepth int                   // Image max allowed backing file chain depth (0 = DefaultMaxBackingChainDepth)
+	QMPSocket            string                // QMP monitor address ("unix:/path" or "tcp:host:port"), set by AttachQMP
+	QMPNodeName          string                // block node-name / device id QMP snapshot commands should target
+	snapshots            []Snapshot            // Image snapshot array
+	qmp                  *QMPClient            // live QMP connection, set by AttachQMP
+	qmpOverlays          map[string]qmpOverlay // live snapshot name -> tracked overlay node, for QMP-driven snapshots
+	qmpActiveNode        string                // block node-name the guest is currently pivoted onto, set by QMP-driven snapshots
 }
 
 // Snapshot represents a QEMU image snapshot
@@ -154,6 +165,10 @@ func OpenEncryptedImage(path, secret string) (Image, error) {
 }
 
 func (i *Image) retreiveInfos() (Image, error) {
+	return i.retreiveInfosContext(context.Background())
+}
+
+func (i *Image) retreiveInfosContext(ctx context.Context) (Image, error) {
 	type snapshotInfo struct {
 		ID        string `json:"id"`
 		Name      string `json:"name"`
@@ -173,11 +188,9 @@ func (i *Image) retreiveInfos() (Image, error) {
 
 	var info imgInfo
 
-	cmd := exec.Command("qemu-img", "info", "--output=json", i.Path)
-
-	out, err := cmd.CombinedOutput()
+	out, err := runQemuImgContext(ctx, "qemu-img info", i.Path, "info", "--output=json", i.Path)
 	if err != nil {
-		return *i, fmt.Errorf("'qemu-img info' output: %s", oneLine(out))
+		return *i, err
 	}
 
 	err = json.Unmarshal(out, &info)
@@ -228,65 +241,81 @@ func (i Image) Snapshots() ([]Snapshot, error) {
 	return i.snapshots, nil
 }
 
+// AttachQMP connects to the QMP monitor of a running QEMU instance at
+// path ("unix:/path/to/sock" or "tcp:host:port"). Once attached,
+// CreateSnapshot, RestoreSnapshot and DeleteSnapshot drive the snapshot
+// live through QMP instead of shelling out to qemu-img, which would
+// otherwise fail or corrupt state against an in-use image.
+func (i *Image) AttachQMP(path string) error {
+	network, address, err := parseQMPAddress(path)
+	if err != nil {
+		return err
+	}
+
+	client, err := DialQMP(network, address)
+	if err != nil {
+		return err
+	}
+
+	i.QMPSocket = path
+	i.qmp = client
+	return nil
+}
+
+// DetachQMP closes the live QMP connection, if any, reverting the image
+// to driving snapshots through qemu-img.
+func (i *Image) DetachQMP() error {
+	if i.qmp == nil {
+		return nil
+	}
+
+	err := i.qmp.Close()
+	i.qmp = nil
+	return err
+}
+
 // CreateSnapshot creates a snapshot of the image
 // with the specified name
 func (i *Image) CreateSnapshot(name string) (Snapshot, error) {
+	return i.CreateSnapshotContext(context.Background(), name)
+}
+
+// CreateSnapshotContext is CreateSnapshot with ctx controlling
+// cancellation of the underlying qemu-img process.
+func (i *Image) CreateSnapshotContext(ctx context.Context, name string) (Snapshot, error) {
 	var snap Snapshot
+
+	if i.qmp != nil {
+		return i.createSnapshotQMP(name)
+	}
+
 	// Handles normal volumes
 	if i.Encrypted == false {
-		cmd := exec.Command("qemu-img", "snapshot", "-c", name, i.Path)
-
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			return snap, fmt.Errorf("'qemu-img snapshot' output: %s", oneLine(out))
-		}
-		snaps, err := i.Snapshots()
-		if err != nil {
+		if _, err := runQemuImgContext(ctx, "qemu-img snapshot", i.Path, "snapshot", "-c", name, i.Path); err != nil {
 			return snap, err
 		}
-
-		var exists bool
-		for _, s := range snaps {
-			if s.Name == name {
-				snap = s
-				exists = true
-				break
-			}
-		}
-
-		if exists {
-			return snap, nil
-		} else {
-			return snap, fmt.Errorf("couldn't find newly created snapshot")
+	} else {
+		// Handles encrypted volumes
+		if _, err := runQemuImgContext(ctx, "qemu-img snapshot", i.Path,
+			"snapshot", "--object", "secret,id=sec0,data="+i.Secret, "--image-opts", "-c", name,
+			"encrypt.format=luks,encrypt.key-secret=sec0,file.filename="+i.Path,
+		); err != nil {
+			return snap, err
 		}
 	}
-	// Handles encrypted volumes
-	cmd := exec.Command("qemu-img", "snapshot", "--object", "secret,id=sec0,data="+i.Secret, "--image-opts", "-c", name, "encrypt.format=luks,encrypt.key-secret=sec0,file.filename="+i.Path)
-
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return snap, fmt.Errorf("'qemu-img snapshot' output: %s", oneLine(out))
-	}
 
 	snaps, err := i.Snapshots()
 	if err != nil {
 		return snap, err
 	}
 
-	var exists bool
 	for _, s := range snaps {
 		if s.Name == name {
-			snap = s
-			exists = true
-			break
+			return s, nil
 		}
 	}
 
-	if exists {
-		return snap, nil
-	} else {
-		return snap, fmt.Errorf("couldn't find newly created snapshot")
-	}
+	return snap, fmt.Errorf("couldn't find newly created snapshot")
 }
 
 // OptimizeSpeed Optimizes the way QEMU handles caching of data while writing to a volume.
@@ -335,51 +364,54 @@ func (i Image) OptimizeSize() Image {
 
 // RestoreSnapshot restores the the image to the
 // specified snapshot name
-func (i Image) RestoreSnapshot(name string) error {
-	// Handles normal volumes
-	if i.Encrypted == false {
-		cmd := exec.Command("qemu-img", "snapshot", "-a", name, i.Path)
-
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("'qemu-img snapshot' output: %s", oneLine(out))
-		}
+func (i *Image) RestoreSnapshot(name string) error {
+	return i.RestoreSnapshotContext(context.Background(), name)
+}
 
-		return nil
+// RestoreSnapshotContext is RestoreSnapshot with ctx controlling
+// cancellation of the underlying qemu-img process.
+func (i *Image) RestoreSnapshotContext(ctx context.Context, name string) error {
+	if i.qmp != nil {
+		return i.restoreSnapshotQMP(name)
 	}
-	// Handles encrypted volumes
-	cmd := exec.Command("qemu-img", "snapshot", "--object", "secret,id=sec0,data="+i.Secret, "--image-opts", "-a", name, "encrypt.format=luks,encrypt.key-secret=sec0,file.filename="+i.Path)
 
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("'qemu-img snapshot' output: %s", oneLine(out))
+	// Handles normal volumes
+	if i.Encrypted == false {
+		_, err := runQemuImgContext(ctx, "qemu-img snapshot", i.Path, "snapshot", "-a", name, i.Path)
+		return err
 	}
 
-	return nil
+	// Handles encrypted volumes
+	_, err := runQemuImgContext(ctx, "qemu-img snapshot", i.Path,
+		"snapshot", "--object", "secret,id=sec0,data="+i.Secret, "--image-opts", "-a", name,
+		"encrypt.format=luks,encrypt.key-secret=sec0,file.filename="+i.Path,
+	)
+	return err
 }
 
 // DeleteSnapshot deletes the the corresponding
 // snapshot from the image
 func (i Image) DeleteSnapshot(name string) error {
-	if i.Encrypted == false {
-		cmd := exec.Command("qemu-img", "snapshot", "-d", name, i.Path)
-
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("'qemu-img snapshot' output: %s", oneLine(out))
-		}
+	return i.DeleteSnapshotContext(context.Background(), name)
+}
 
-		return nil
+// DeleteSnapshotContext is DeleteSnapshot with ctx controlling
+// cancellation of the underlying qemu-img process.
+func (i Image) DeleteSnapshotContext(ctx context.Context, name string) error {
+	if i.qmp != nil {
+		return i.deleteSnapshotQMP(name)
 	}
 
-	cmd := exec.Command("qemu-img", "snapshot", "--object", "secret,id=sec0,data="+i.Secret, "--image-opts", "-d", name, "encrypt.format=luks,encrypt.key-secret=sec0,file.filename="+i.Path)
-
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("'qemu-img snapshot' output: %s", oneLine(out))
+	if i.Encrypted == false {
+		_, err := runQemuImgContext(ctx, "qemu-img snapshot", i.Path, "snapshot", "-d", name, i.Path)
+		return err
 	}
 
-	return nil
+	_, err := runQemuImgContext(ctx, "qemu-img snapshot", i.Path,
+		"snapshot", "--object", "secret,id=sec0,data="+i.Secret, "--image-opts", "-d", name,
+		"encrypt.format=luks,encrypt.key-secret=sec0,file.filename="+i.Path,
+	)
+	return err
 }
 
 // SetBackingFile sets a backing file for the image
@@ -390,6 +422,10 @@ func (i *Image) SetBackingFile(backingFile string) error {
 		return err
 	}
 
+	if err := i.ValidateBackingChain(backingFile); err != nil {
+		return err
+	}
+
 	i.BackingFile = backingFile
 	return nil
 }
@@ -398,10 +434,20 @@ func (i *Image) SetBackingFile(backingFile string) error {
 // using the 'qemu-img create' command. If a secret is set, the volume is provisioned
 // with encryption enabled.
 func (i Image) Create() error {
+	return i.CreateContext(context.Background())
+}
+
+// CreateContext is Create with ctx controlling cancellation of the
+// underlying qemu-img process, useful for aborting a multi-hour create
+// against a large preallocated image.
+func (i Image) CreateContext(ctx context.Context) error {
 	if i.Encrypted == false {
 		args := []string{"create", "-f", i.Format}
 
 		if len(i.BackingFile) > 0 {
+			if err := i.ValidateBackingChainContext(ctx, i.BackingFile); err != nil {
+				return err
+			}
 			args = append(args, "-o")
 			args = append(args, fmt.Sprintf("backing_file=%s", i.BackingFile))
 		}
@@ -436,20 +482,17 @@ func (i Image) Create() error {
 		args = append(args, i.Path)
 		args = append(args, strconv.FormatUint(i.Size, 10))
 
-		cmd := exec.Command("qemu-img", args...)
-
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("'qemu-img create' output: %s", oneLine(out))
-		}
-
-		return nil
+		_, err := runQemuImgContext(ctx, "qemu-img create", i.Path, args...)
+		return err
 	}
 	if i.Format != ImageFormatQCOW2 {
 		return fmt.Errorf("encrypted volumes must be qcow2 format")
 	}
 	args := []string{"create", "--object", "secret,id=sec0,data=" + i.Secret, "-f", i.Format, "-o", "encrypt.key-secret=sec0"}
 	if len(i.BackingFile) > 0 {
+		if err := i.ValidateBackingChainContext(ctx, i.BackingFile); err != nil {
+			return err
+		}
 		args = append(args, "-o")
 		args = append(args, fmt.Sprintf("backing_file=%s", i.BackingFile))
 	}
@@ -508,27 +551,25 @@ func (i Image) Create() error {
 	args = append(args, i.Path)
 	args = append(args, strconv.FormatUint(i.Size, 10))
 
-	cmd := exec.Command("qemu-img", args...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("'qemu-img create' output: %s", oneLine(out))
-	}
-
-	return nil
-
+	_, err := runQemuImgContext(ctx, "qemu-img create", i.Path, args...)
+	return err
 }
 
 // Rebase changes the backing file of the image
 // to the specified file path
 func (i *Image) Rebase(backingFile string) error {
-	i.BackingFile = backingFile
-
-	cmd := exec.Command("qemu-img", "rebase", "-b", backingFile, i.Path)
+	return i.RebaseContext(context.Background(), backingFile)
+}
 
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("'qemu-img rebase' output: %s", oneLine(out))
+// RebaseContext is Rebase with ctx controlling cancellation of the
+// underlying qemu-img process.
+func (i *Image) RebaseContext(ctx context.Context, backingFile string) error {
+	if err := i.ValidateBackingChainContext(ctx, backingFile); err != nil {
+		return err
 	}
 
-	return nil
+	i.BackingFile = backingFile
+
+	_, err := runQemuImgContext(ctx, "qemu-img rebase", i.Path, "rebase", "-b", backingFile, i.Path)
+	return err
 }
@@ -0,0 +1,183 @@
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Keyslot describes a single LUKS keyslot on an encrypted qcow2 image,
+// as reported under format-specific.data.encrypt.slots by 'qemu-img info'.
+type Keyslot struct {
+	Index     int   // Keyslot index
+	Active    bool  // Whether the keyslot currently holds a usable key
+	Iters     int64 // PBKDF iteration count used to derive the slot's key
+	KeyOffset int64 // Byte offset of the slot's key material on disk
+}
+
+// KDF configures the key derivation function used when provisioning a
+// single LUKS keyslot, so that slots can be tuned independently (e.g. a
+// fast-unlock slot for automation next to a slow, high-iteration slot
+// for an interactively-typed passphrase).
+type KDF struct {
+	IterTimeMS int64  // PBKDF iteration time in milliseconds
+	HashAlg    string // e.g. CipherHashAlgorithmSHA256
+	IVGenAlg   string // e.g. IVGenAlgPlain64
+}
+
+func (i Image) requireLUKS() error {
+	if !i.Encrypted {
+		return fmt.Errorf("image is not encrypted")
+	}
+	if i.CipherFormat != "" && i.CipherFormat != CipherFormatLUKS {
+		return fmt.Errorf("keyslot management requires encrypt.format=luks, image is %q", i.CipherFormat)
+	}
+	return nil
+}
+
+// ListKeyslots returns the LUKS keyslots currently provisioned on the
+// image, parsed from 'qemu-img info --output=json'.
+func (i Image) ListKeyslots() ([]Keyslot, error) {
+	if err := i.requireLUKS(); err != nil {
+		return nil, err
+	}
+
+	type slotInfo struct {
+		Active    bool  `json:"active"`
+		Iters     int64 `json:"iters,omitempty"`
+		KeyOffset int64 `json:"key-offset,omitempty"`
+	}
+
+	type formatSpecific struct {
+		Type string `json:"type"`
+		Data struct {
+			Encrypt struct {
+				Slots []slotInfo `json:"slots"`
+			} `json:"encrypt"`
+		} `json:"data"`
+	}
+
+	type imgInfo struct {
+		FormatSpecific formatSpecific `json:"format-specific"`
+	}
+
+	out, err := runQemuImgContext(context.Background(), "qemu-img info", i.Path, "info", "--output=json", i.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var info imgInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil, fmt.Errorf("'qemu-img info' invalid json output")
+	}
+
+	slots := make([]Keyslot, 0, len(info.FormatSpecific.Data.Encrypt.Slots))
+	for idx, s := range info.FormatSpecific.Data.Encrypt.Slots {
+		slots = append(slots, Keyslot{
+			Index:     idx,
+			Active:    s.Active,
+			Iters:     s.Iters,
+			KeyOffset: s.KeyOffset,
+		})
+	}
+
+	return slots, nil
+}
+
+// amendLUKS runs 'qemu-img amend' against the image's LUKS encryption
+// state, registering each entry of secretObjects as a secret object
+// (object id -> secret data) and passing each of opts as a -o option.
+func (i Image) amendLUKS(secretObjects map[string]string, opts []string) error {
+	args := []string{"amend"}
+
+	for id, data := range secretObjects {
+		args = append(args, "--object", fmt.Sprintf("secret,id=%s,data=%s", id, data))
+	}
+
+	args = append(args, "-f", ImageFormatQCOW2)
+	for _, opt := range opts {
+		args = append(args, "-o", opt)
+	}
+	args = append(args, i.Path)
+
+	_, err := runQemuImgContext(context.Background(), "qemu-img amend", i.Path, args...)
+	return err
+}
+
+// AddKeyslot provisions a new LUKS keyslot holding newSecret, authenticated
+// by the image's current secret, using default KDF parameters.
+func (i *Image) AddKeyslot(newSecret string) error {
+	return i.AddKeyslotWithKDF(newSecret, KDF{})
+}
+
+// AddKeyslotWithKDF provisions a new LUKS keyslot holding newSecret,
+// authenticated by the image's current secret, tuning the PBKDF with kdf.
+func (i *Image) AddKeyslotWithKDF(newSecret string, kdf KDF) error {
+	if err := i.requireLUKS(); err != nil {
+		return err
+	}
+
+	opts := []string{"encrypt.state=active", "encrypt.old-secret=sec0", "encrypt.new-secret=sec1"}
+	if kdf.IterTimeMS != 0 {
+		opts = append(opts, fmt.Sprintf("encrypt.iter-time=%d", kdf.IterTimeMS))
+	}
+	if kdf.HashAlg != "" {
+		opts = append(opts, fmt.Sprintf("encrypt.hash-alg=%s", kdf.HashAlg))
+	}
+	if kdf.IVGenAlg != "" {
+		opts = append(opts, fmt.Sprintf("encrypt.ivgen-alg=%s", kdf.IVGenAlg))
+	}
+
+	return i.amendLUKS(map[string]string{"sec0": i.Secret, "sec1": newSecret}, opts)
+}
+
+// RemoveKeyslot deactivates the keyslot at the given index, authenticated
+// by the image's current secret. The slot's key material is wiped and
+// can no longer be used to unlock the image.
+func (i *Image) RemoveKeyslot(slot int) error {
+	if err := i.requireLUKS(); err != nil {
+		return err
+	}
+
+	opts := []string{
+		"encrypt.state=inactive",
+		"encrypt.old-secret=sec0",
+		fmt.Sprintf("encrypt.keyslot=%d", slot),
+	}
+
+	return i.amendLUKS(map[string]string{"sec0": i.Secret}, opts)
+}
+
+// RotateSecret replaces the image's passphrase: it provisions a new
+// keyslot for newSecret (authenticated by oldSecret), then deactivates
+// every keyslot that was active beforehand, leaving newSecret as the
+// sole usable passphrase.
+func (i *Image) RotateSecret(oldSecret, newSecret string) error {
+	if err := i.requireLUKS(); err != nil {
+		return err
+	}
+
+	before, err := i.ListKeyslots()
+	if err != nil {
+		return err
+	}
+
+	previousSecret := i.Secret
+	i.Secret = oldSecret
+	if err := i.AddKeyslot(newSecret); err != nil {
+		i.Secret = previousSecret
+		return fmt.Errorf("provisioning rotated keyslot: %w", err)
+	}
+
+	i.Secret = newSecret
+	for _, slot := range before {
+		if !slot.Active {
+			continue
+		}
+		if err := i.RemoveKeyslot(slot.Index); err != nil {
+			return fmt.Errorf("deactivating previous keyslot %d: %w", slot.Index, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,538 @@
+package qemu
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QMPEvent represents an asynchronous event delivered by QEMU over the
+// QMP monitor, such as BLOCK_JOB_COMPLETED or BLOCK_JOB_ERROR.
+type QMPEvent struct {
+	Event     string                 // Event name, e.g. "BLOCK_JOB_COMPLETED"
+	Data      map[string]interface{} // Event-specific payload
+	Timestamp time.Time              // Time the event was received
+}
+
+// QMPClient is a connection to a running QEMU instance's QMP monitor.
+// It can be dialed over a Unix socket or TCP, negotiates capabilities
+// on connect, and lets callers issue commands and subscribe to events
+// while a VM is live.
+type QMPClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mu     sync.Mutex // serializes command execution on the wire
+
+	events  chan QMPEvent
+	pending chan qmpResult
+
+	subMu       sync.Mutex
+	subscribers map[string]chan QMPEvent // block job/device id -> its subscriber
+
+	closed int32
+}
+
+// qmpResult carries the outcome of a single QMP command, successful or
+// not, through the pending channel, so a connection drop can be reported
+// without ever blocking Execute's wait on a value that will never arrive.
+type qmpResult struct {
+	ret json.RawMessage
+	err error
+}
+
+type qmpGreeting struct {
+	QMP struct {
+		Version      interface{} `json:"version"`
+		Capabilities []string    `json:"capabilities"`
+	} `json:"QMP"`
+}
+
+type qmpMessage struct {
+	Return    json.RawMessage        `json:"return,omitempty"`
+	Error     *qmpError              `json:"error,omitempty"`
+	Event     string                 `json:"event,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Timestamp *struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp,omitempty"`
+}
+
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+// DialQMP connects to a QEMU QMP monitor over the given network
+// ("unix" or "tcp") and negotiates capabilities before returning.
+func DialQMP(network, address string) (*QMPClient, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("dialing qmp socket %s:%s: %w", network, address, err)
+	}
+
+	c := &QMPClient{
+		conn:        conn,
+		reader:      bufio.NewReader(conn),
+		events:      make(chan QMPEvent, 64),
+		pending:     make(chan qmpResult, 1),
+		subscribers: make(map[string]chan QMPEvent),
+	}
+
+	var greeting qmpGreeting
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading qmp greeting: %w", err)
+	}
+	if err := json.Unmarshal(line, &greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("parsing qmp greeting: %w", err)
+	}
+
+	go c.readLoop()
+
+	if _, err := c.Execute("qmp_capabilities", nil); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("negotiating qmp capabilities: %w", err)
+	}
+
+	return c, nil
+}
+
+// parseQMPAddress splits an "unix:/path/to/sock" or "tcp:host:port"
+// address, as accepted by Image.AttachQMP, into a net.Dial network/address pair.
+func parseQMPAddress(path string) (network, address string, err error) {
+	parts := strings.SplitN(path, ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("qmp address %q must be of the form \"unix:/path\" or \"tcp:host:port\"", path)
+	}
+
+	switch parts[0] {
+	case "unix":
+		return "unix", parts[1], nil
+	case "tcp":
+		return "tcp", parts[1], nil
+	default:
+		return "", "", fmt.Errorf("qmp address %q has unsupported scheme %q", path, parts[0])
+	}
+}
+
+func (c *QMPClient) readLoop() {
+	for {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			atomic.StoreInt32(&c.closed, 1)
+			select {
+			case c.pending <- qmpResult{err: fmt.Errorf("qmp connection closed: %w", err)}:
+			default:
+				// No Execute call is waiting on this connection right
+				// now; there's no one left to deliver the error to.
+			}
+			c.subMu.Lock()
+			for _, sub := range c.subscribers {
+				close(sub)
+			}
+			c.subscribers = nil
+			c.subMu.Unlock()
+			close(c.events)
+			return
+		}
+
+		var msg qmpMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			continue
+		}
+
+		if msg.Event != "" {
+			ts := time.Now()
+			if msg.Timestamp != nil {
+				ts = time.Unix(msg.Timestamp.Seconds, msg.Timestamp.Microseconds*1000)
+			}
+			c.dispatchEvent(QMPEvent{Event: msg.Event, Data: msg.Data, Timestamp: ts})
+			continue
+		}
+
+		var res qmpResult
+		if msg.Error != nil {
+			res.err = fmt.Errorf("qmp error (%s): %s", msg.Error.Class, msg.Error.Desc)
+		} else {
+			res.ret = msg.Return
+		}
+
+		select {
+		case c.pending <- res:
+		default:
+			// The caller that issued this command already gave up on it
+			// (e.g. its ExecuteContext deadline passed); there's nothing
+			// left to deliver the result to, so drop it rather than
+			// block subsequent replies forever.
+		}
+	}
+}
+
+// Execute sends a QMP command and waits for its matching return or error.
+func (c *QMPClient) Execute(command string, args map[string]interface{}) (json.RawMessage, error) {
+	return c.ExecuteContext(context.Background(), command, args)
+}
+
+// ExecuteContext is Execute with ctx bounding how long to wait for QEMU's
+// reply. A dropped connection (or a never-answered command) unblocks the
+// caller via ctx instead of hanging forever on a reply that will never
+// arrive, which would otherwise also wedge every later call on c behind
+// the mutex below.
+func (c *QMPClient) ExecuteContext(ctx context.Context, command string, args map[string]interface{}) (json.RawMessage, error) {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return nil, fmt.Errorf("qmp client is closed")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	req := map[string]interface{}{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+
+	enc, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("encoding qmp command %q: %w", command, err)
+	}
+
+	if _, err := c.conn.Write(append(enc, '\n')); err != nil {
+		return nil, fmt.Errorf("writing qmp command %q: %w", command, err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-c.pending:
+		return res.ret, res.err
+	}
+}
+
+// Events returns the channel on which asynchronous QMP events not bound
+// to a job someone has subscribed to via subscribeJob (e.g. via
+// WaitForBlockJob or a running Backup) are delivered.
+func (c *QMPClient) Events() <-chan QMPEvent {
+	return c.events
+}
+
+// blockJobID extracts the block job/device id an event is about, as
+// reported under either "device" (older QEMU) or "id" (newer QEMU).
+func blockJobID(ev QMPEvent) string {
+	id, _ := ev.Data["device"].(string)
+	if id == "" {
+		id, _ = ev.Data["id"].(string)
+	}
+	return id
+}
+
+// dispatchEvent routes ev to the subscriber registered for its block job
+// id, if any, falling back to the shared Events() stream otherwise. This
+// keeps concurrent block jobs on one connection (e.g. two backups, or a
+// backup racing a live snapshot's WaitForBlockJob) from stealing each
+// other's BLOCK_JOB_* events off a single shared channel.
+func (c *QMPClient) dispatchEvent(ev QMPEvent) {
+	if id := blockJobID(ev); id != "" {
+		c.subMu.Lock()
+		sub, ok := c.subscribers[id]
+		c.subMu.Unlock()
+
+		if ok {
+			select {
+			case sub <- ev:
+			default:
+				// Drop rather than block the read loop if the subscriber
+				// isn't keeping up.
+			}
+			return
+		}
+	}
+
+	select {
+	case c.events <- ev:
+	default:
+		// Drop the event rather than block the read loop if no one is
+		// draining Events().
+	}
+}
+
+// subscribeJob registers a channel that dispatchEvent will deliver id's
+// BLOCK_JOB_* events to instead of the shared Events() stream. Callers
+// must call unsubscribeJob(id) once done watching, typically via defer.
+// The returned channel is closed if the connection drops while a
+// subscription is active.
+func (c *QMPClient) subscribeJob(id string) <-chan QMPEvent {
+	ch := make(chan QMPEvent, 16)
+
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	if c.subscribers == nil {
+		// readLoop has already torn down the connection; hand back a
+		// closed channel so the caller sees "no more events" immediately
+		// instead of subscribing to a registry that will never dispatch.
+		close(ch)
+		return ch
+	}
+
+	c.subscribers[id] = ch
+	return ch
+}
+
+// unsubscribeJob removes the subscription registered by subscribeJob(id).
+func (c *QMPClient) unsubscribeJob(id string) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	if c.subscribers != nil {
+		delete(c.subscribers, id)
+	}
+}
+
+// Close terminates the QMP connection.
+func (c *QMPClient) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// WaitForBlockJob blocks until the block job identified by id reports
+// BLOCK_JOB_COMPLETED, returns an error if it reports BLOCK_JOB_ERROR,
+// or ctx is cancelled. It subscribes for id's events specifically, so it
+// can run concurrently with a Backup (or another WaitForBlockJob) on the
+// same connection without either stealing the other's completion event.
+func (c *QMPClient) WaitForBlockJob(ctx context.Context, id string) error {
+	sub := c.subscribeJob(id)
+	defer c.unsubscribeJob(id)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-sub:
+			if !ok {
+				return fmt.Errorf("qmp connection closed while waiting for block job %q", id)
+			}
+
+			switch ev.Event {
+			case "BLOCK_JOB_COMPLETED":
+				return nil
+			case "BLOCK_JOB_ERROR":
+				msg, _ := ev.Data["error"].(string)
+				return fmt.Errorf("block job %q failed: %s", id, msg)
+			}
+		}
+	}
+}
+
+// blockdevAdd issues blockdev-add for the given node, backed by the
+// driver/options described in opts.
+func (c *QMPClient) blockdevAdd(opts map[string]interface{}) error {
+	_, err := c.Execute("blockdev-add", opts)
+	return err
+}
+
+// blockdevDel issues blockdev-del for the given node name.
+func (c *QMPClient) blockdevDel(nodeName string) error {
+	_, err := c.Execute("blockdev-del", map[string]interface{}{"node-name": nodeName})
+	return err
+}
+
+// blockdevSnapshotSync issues the legacy blockdev-snapshot-sync command,
+// creating a new overlay file on top of device and switching the guest
+// to write to it.
+func (c *QMPClient) blockdevSnapshotSync(device, snapshotFile, format string) error {
+	_, err := c.Execute("blockdev-snapshot-sync", map[string]interface{}{
+		"device":        device,
+		"snapshot-file": snapshotFile,
+		"format":        format,
+	})
+	return err
+}
+
+// blockdevSnapshot issues blockdev-snapshot, pivoting node to overlayNode
+// which must already have been registered via blockdev-add.
+func (c *QMPClient) blockdevSnapshot(node, overlayNode string) error {
+	_, err := c.Execute("blockdev-snapshot", map[string]interface{}{
+		"node":    node,
+		"overlay": overlayNode,
+	})
+	return err
+}
+
+// qmpNodeName returns the block node-name / device id QMP snapshot
+// commands should target, defaulting to "drive0" when the caller hasn't
+// set Image.QMPNodeName explicitly.
+func (i Image) qmpNodeName() string {
+	if i.QMPNodeName != "" {
+		return i.QMPNodeName
+	}
+	return "drive0"
+}
+
+// qmpOverlay tracks a single QMP-driven live snapshot: the overlay file
+// backing it, the blockdev node-name it was registered under, and the
+// node it was pivoted from, so restore/delete can act on the same node
+// create registered rather than reconstructing the name independently.
+type qmpOverlay struct {
+	path       string
+	nodeName   string
+	parentNode string
+}
+
+// qmpCurrentNode returns the block node-name the guest is currently
+// pivoted onto: the node-name of the most recently created or restored
+// live snapshot, or the image's base node (qmpNodeName) if none yet.
+func (i Image) qmpCurrentNode() string {
+	if i.qmpActiveNode != "" {
+		return i.qmpActiveNode
+	}
+	return i.qmpNodeName()
+}
+
+// qmpCurrentPath returns the file path the guest is currently pivoted
+// onto, mirroring qmpCurrentNode.
+func (i Image) qmpCurrentPath() string {
+	for name, ov := range i.qmpOverlays {
+		if ov.nodeName == i.qmpActiveNode {
+			return ov.path
+		}
+		// restoreSnapshotQMP pivots onto "restore-<name>", backed by a
+		// fresh overlay it forks next to the image.
+		if "restore-"+name == i.qmpActiveNode {
+			return fmt.Sprintf("%s.restore-%s.qcow2", i.Path, name)
+		}
+	}
+	return i.Path
+}
+
+// qmpCurrentFormat returns the image format of the file the guest is
+// currently pivoted onto, mirroring qmpCurrentPath. Every overlay pivotTo
+// creates is itself a qcow2 file (only its *backing* file's format
+// varies), so this is i.Format before any snapshot has pivoted, and
+// ImageFormatQCOW2 afterwards.
+func (i Image) qmpCurrentFormat() string {
+	if i.qmpActiveNode == "" {
+		return i.Format
+	}
+	return ImageFormatQCOW2
+}
+
+// pivotTo creates a new qcow2 overlay backed by basePath (whose image
+// format is baseFormat), registers it as nodeName via blockdev-add, and
+// pivots the guest onto it via blockdev-snapshot. It's the shared
+// mechanics behind both taking a new live snapshot and restoring to an
+// earlier one: in both cases the guest ends up writing into a fresh
+// overlay derived from a known-good base.
+func (i *Image) pivotTo(nodeName, overlay, basePath, baseFormat string) error {
+	if _, err := runQemuImgContext(context.Background(), "qemu-img create", overlay,
+		"create", "-f", ImageFormatQCOW2, "-b", basePath, "-F", baseFormat, overlay); err != nil {
+		return err
+	}
+
+	if err := i.qmp.blockdevAdd(map[string]interface{}{
+		"node-name": nodeName,
+		"driver":    ImageFormatQCOW2,
+		"file": map[string]interface{}{
+			"driver":   "file",
+			"filename": overlay,
+		},
+	}); err != nil {
+		return fmt.Errorf("qmp blockdev-add: %w", err)
+	}
+
+	if err := i.qmp.blockdevSnapshot(i.qmpCurrentNode(), nodeName); err != nil {
+		return fmt.Errorf("qmp blockdev-snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// createSnapshotQMP implements CreateSnapshot against a live VM by
+// creating a new qcow2 overlay on top of the image's current block node
+// via blockdev-add + blockdev-snapshot, and pivoting the guest onto it.
+func (i *Image) createSnapshotQMP(name string) (Snapshot, error) {
+	var snap Snapshot
+
+	overlay := fmt.Sprintf("%s.snap-%s.qcow2", i.Path, name)
+	nodeName := "snap-" + name
+	parentNode := i.qmpCurrentNode()
+
+	if err := i.pivotTo(nodeName, overlay, i.qmpCurrentPath(), i.qmpCurrentFormat()); err != nil {
+		return snap, err
+	}
+
+	if i.qmpOverlays == nil {
+		i.qmpOverlays = make(map[string]qmpOverlay)
+	}
+	i.qmpOverlays[name] = qmpOverlay{path: overlay, nodeName: nodeName, parentNode: parentNode}
+	i.qmpActiveNode = nodeName
+
+	snap.ID = len(i.snapshots) + 1
+	snap.Name = name
+	snap.Date = time.Now()
+	i.snapshots = append(i.snapshots, snap)
+
+	return snap, nil
+}
+
+// restoreSnapshotQMP implements RestoreSnapshot against a live VM. Since
+// the overlay node recorded for name already has its own backing file
+// set (blockdev-snapshot refuses to repivot an overlay that already has
+// one), it can't simply be re-targeted; instead a fresh overlay is
+// forked from the snapshot's recorded file and the guest is pivoted onto
+// that, so it resumes writing from exactly the state name captured.
+func (i *Image) restoreSnapshotQMP(name string) error {
+	ov, ok := i.qmpOverlays[name]
+	if !ok {
+		return fmt.Errorf("no live snapshot named %q is attached via qmp", name)
+	}
+
+	restoreOverlay := fmt.Sprintf("%s.restore-%s.qcow2", i.Path, name)
+	nodeName := "restore-" + name
+
+	// ov.path is itself an overlay pivotTo previously created, so it's
+	// always qcow2 regardless of the original image's format.
+	if err := i.pivotTo(nodeName, restoreOverlay, ov.path, ImageFormatQCOW2); err != nil {
+		return err
+	}
+
+	i.qmpActiveNode = nodeName
+
+	return nil
+}
+
+// deleteSnapshotQMP implements DeleteSnapshot against a live VM by
+// detaching and removing the overlay node recorded for name.
+func (i Image) deleteSnapshotQMP(name string) error {
+	ov, ok := i.qmpOverlays[name]
+	if !ok {
+		return fmt.Errorf("no live snapshot named %q is attached via qmp", name)
+	}
+
+	if i.qmpActiveNode == ov.nodeName {
+		return fmt.Errorf("cannot delete live snapshot %q: guest is currently pivoted onto it", name)
+	}
+
+	if err := i.qmp.blockdevDel(ov.nodeName); err != nil {
+		return fmt.Errorf("qmp blockdev-del: %w", err)
+	}
+
+	delete(i.qmpOverlays, name)
+
+	if err := os.Remove(ov.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing overlay file %q: %w", ov.path, err)
+	}
+
+	return nil
+}
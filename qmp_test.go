@@ -0,0 +1,211 @@
+package qemu
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestQMPClient wires up a QMPClient against one end of an in-memory
+// net.Pipe, with readLoop already running, and hands back the other end
+// so the test can play QEMU: write event lines and command replies, and
+// read back the commands the client sends.
+func newTestQMPClient(t *testing.T) (*QMPClient, net.Conn) {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close(); serverConn.Close() })
+
+	c := &QMPClient{
+		conn:        clientConn,
+		reader:      bufio.NewReader(clientConn),
+		events:      make(chan QMPEvent, 64),
+		pending:     make(chan qmpResult, 1),
+		subscribers: make(map[string]chan QMPEvent),
+	}
+	go c.readLoop()
+
+	return c, serverConn
+}
+
+func readLine(t *testing.T, conn net.Conn) map[string]interface{} {
+	t.Helper()
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("reading line from client: %v", err)
+	}
+
+	var v map[string]interface{}
+	if err := json.Unmarshal(line, &v); err != nil {
+		t.Fatalf("unmarshaling client line %q: %v", line, err)
+	}
+	return v
+}
+
+func writeLine(t *testing.T, conn net.Conn, v interface{}) {
+	t.Helper()
+
+	enc, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshaling line: %v", err)
+	}
+	if _, err := conn.Write(append(enc, '\n')); err != nil {
+		t.Fatalf("writing line to server: %v", err)
+	}
+}
+
+func TestQMPClient_ExecuteFramesCommand(t *testing.T) {
+	c, server := newTestQMPClient(t)
+
+	resultCh := make(chan json.RawMessage, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		ret, err := c.Execute("human-monitor-command", map[string]interface{}{"command-line": "info status"})
+		resultCh <- ret
+		errCh <- err
+	}()
+
+	req := readLine(t, server)
+	if req["execute"] != "human-monitor-command" {
+		t.Fatalf("got execute %v, want %q", req["execute"], "human-monitor-command")
+	}
+	args, _ := req["arguments"].(map[string]interface{})
+	if args["command-line"] != "info status" {
+		t.Fatalf("got arguments %v, want command-line %q", args, "info status")
+	}
+
+	writeLine(t, server, map[string]interface{}{"return": map[string]interface{}{"ok": true}})
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("Execute returned error: %v", err)
+	}
+	ret := <-resultCh
+	if !bytes.Contains(ret, []byte(`"ok":true`)) {
+		t.Fatalf("got return %s, want it to contain ok:true", ret)
+	}
+}
+
+func TestQMPClient_ExecuteSurfacesQMPError(t *testing.T) {
+	c, server := newTestQMPClient(t)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.Execute("blockdev-add", nil)
+		errCh <- err
+	}()
+
+	readLine(t, server)
+	writeLine(t, server, map[string]interface{}{
+		"error": map[string]interface{}{"class": "GenericError", "desc": "boom"},
+	})
+
+	err := <-errCh
+	if err == nil {
+		t.Fatal("got nil error, want the qmp error to surface")
+	}
+}
+
+func TestQMPClient_DispatchEvent_RoutesToSubscriber(t *testing.T) {
+	c, server := newTestQMPClient(t)
+
+	sub := c.subscribeJob("job0")
+
+	writeLine(t, server, map[string]interface{}{
+		"event": "BLOCK_JOB_COMPLETED",
+		"data":  map[string]interface{}{"device": "job0"},
+	})
+	writeLine(t, server, map[string]interface{}{
+		"event": "SHUTDOWN",
+		"data":  map[string]interface{}{},
+	})
+
+	select {
+	case ev := <-sub:
+		if ev.Event != "BLOCK_JOB_COMPLETED" {
+			t.Fatalf("got event %q on subscriber channel, want BLOCK_JOB_COMPLETED", ev.Event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for subscribed job's event")
+	}
+
+	select {
+	case ev := <-c.Events():
+		if ev.Event != "SHUTDOWN" {
+			t.Fatalf("got event %q on shared channel, want SHUTDOWN", ev.Event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for unsubscribed event on shared channel")
+	}
+
+	c.unsubscribeJob("job0")
+}
+
+// TestQMPClient_DispatchEvent_DoesNotLeakBetweenJobs is the regression
+// test for the bug where every consumer read off the single shared
+// events channel: two jobs racing on one connection must each only see
+// their own BLOCK_JOB_* events, never the other's.
+func TestQMPClient_DispatchEvent_DoesNotLeakBetweenJobs(t *testing.T) {
+	c, server := newTestQMPClient(t)
+
+	subA := c.subscribeJob("jobA")
+	subB := c.subscribeJob("jobB")
+	defer c.unsubscribeJob("jobA")
+	defer c.unsubscribeJob("jobB")
+
+	writeLine(t, server, map[string]interface{}{
+		"event": "BLOCK_JOB_COMPLETED",
+		"data":  map[string]interface{}{"device": "jobA"},
+	})
+	writeLine(t, server, map[string]interface{}{
+		"event": "BLOCK_JOB_COMPLETED",
+		"data":  map[string]interface{}{"device": "jobB"},
+	})
+
+	select {
+	case ev := <-subA:
+		if blockJobID(ev) != "jobA" {
+			t.Fatalf("jobA's subscriber received event for %q", blockJobID(ev))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for jobA's event")
+	}
+
+	select {
+	case ev := <-subB:
+		if blockJobID(ev) != "jobB" {
+			t.Fatalf("jobB's subscriber received event for %q", blockJobID(ev))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for jobB's event")
+	}
+}
+
+func TestQMPClient_ConnectionDropClosesSubscribers(t *testing.T) {
+	c, server := newTestQMPClient(t)
+
+	sub := c.subscribeJob("job0")
+	server.Close()
+
+	select {
+	case _, ok := <-sub:
+		if ok {
+			t.Fatal("got a value on the subscriber channel, want it closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for subscriber channel to close after connection drop")
+	}
+
+	select {
+	case _, ok := <-c.Events():
+		if ok {
+			t.Fatal("got a value on Events(), want it closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Events() to close after connection drop")
+	}
+}
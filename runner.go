@@ -0,0 +1,52 @@
+package qemu
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+)
+
+// maxCapturedOutput bounds how much of a qemu-img process's output
+// runQemuImgContext will hold onto for an error message, so a
+// multi-hour run against a huge image can't balloon memory if it's
+// chatty on stderr.
+const maxCapturedOutput = 64 * 1024
+
+// outputRingBuffer is an io.Writer that keeps only the most recent
+// maxBytes written to it, discarding the oldest data once full.
+type outputRingBuffer struct {
+	buf      []byte
+	maxBytes int
+}
+
+func (r *outputRingBuffer) Write(p []byte) (int, error) {
+	r.buf = append(r.buf, p...)
+	if len(r.buf) > r.maxBytes {
+		r.buf = r.buf[len(r.buf)-r.maxBytes:]
+	}
+	return len(p), nil
+}
+
+// runQemuImgContext runs 'qemu-img' with args under ctx, streaming its
+// combined output through a bounded ring buffer. On failure it returns a
+// structured *Error (see classifyError); ctx cancellation interrupts the
+// underlying process the same way exec.CommandContext always does.
+func runQemuImgContext(ctx context.Context, op, path string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "qemu-img", args...)
+
+	out := &outputRingBuffer{maxBytes: maxCapturedOutput}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if err := cmd.Run(); err != nil {
+		return out.buf, classifyError(op, path, out.buf, err)
+	}
+
+	return out.buf, nil
+}
+
+// oneLine collapses a process's (possibly multi-line) output into a
+// single line suitable for embedding in an error message.
+func oneLine(b []byte) string {
+	return strings.Join(strings.Fields(string(b)), " ")
+}
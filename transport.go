@@ -0,0 +1,387 @@
+package qemu
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Export streams the image out through dst, re-encoding it to format via
+// 'qemu-img convert'. Unlike ConvertTo, the destination never touches
+// disk on this host; it is piped straight to dst as qemu-img writes it.
+func (i Image) Export(ctx context.Context, dst io.Writer, format string) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("creating export pipe: %w", err)
+	}
+	defer r.Close()
+
+	cmd := exec.CommandContext(ctx, "qemu-img", "convert", "-O", format, i.Path, "/dev/fd/3")
+	cmd.ExtraFiles = []*os.File{w}
+
+	stderr := &outputRingBuffer{maxBytes: maxCapturedOutput}
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return fmt.Errorf("starting 'qemu-img convert': %w", err)
+	}
+	w.Close()
+
+	copyErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(dst, r)
+		copyErr <- err
+	}()
+
+	waitErr := cmd.Wait()
+	if err := <-copyErr; err != nil && waitErr == nil {
+		waitErr = fmt.Errorf("streaming export output: %w", err)
+	}
+	if waitErr != nil {
+		if len(stderr.buf) > 0 {
+			return classifyError("qemu-img convert", i.Path, stderr.buf, waitErr)
+		}
+		return waitErr
+	}
+
+	return nil
+}
+
+// Import streams format-encoded image data in from src, converting it
+// into the image at i.Path via 'qemu-img convert'.
+func (i Image) Import(ctx context.Context, src io.Reader, format string) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("creating import pipe: %w", err)
+	}
+	defer w.Close()
+
+	cmd := exec.CommandContext(ctx, "qemu-img", "convert", "-f", format, "-O", i.Format, "/dev/fd/3", i.Path)
+	cmd.ExtraFiles = []*os.File{r}
+
+	stderr := &outputRingBuffer{maxBytes: maxCapturedOutput}
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		return fmt.Errorf("starting 'qemu-img convert': %w", err)
+	}
+	r.Close()
+
+	copyErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(w, src)
+		w.Close()
+		copyErr <- err
+	}()
+
+	waitErr := cmd.Wait()
+	if err := <-copyErr; err != nil && waitErr == nil {
+		waitErr = fmt.Errorf("streaming import input: %w", err)
+	}
+	if waitErr != nil {
+		if len(stderr.buf) > 0 {
+			return classifyError("qemu-img convert", i.Path, stderr.buf, waitErr)
+		}
+		return waitErr
+	}
+
+	return nil
+}
+
+// Transport is a pluggable source/destination for image data that
+// qemu-img can address directly (a local file, an NBD export, an HTTP(S)
+// URL) or that must be staged through this process first (S3).
+type Transport interface {
+	// Source prepares the transport to be read by 'qemu-img convert' and
+	// returns the spec to pass as its source argument, plus a finalize
+	// function to call once the convert attempt has finished. finalize
+	// receives the convert error (nil on success).
+	Source(ctx context.Context) (spec string, finalize func(convertErr error) error, err error)
+
+	// Target prepares the transport to be written by 'qemu-img convert'
+	// and returns the spec to pass as its destination argument, plus a
+	// finalize function that commits the write (e.g. uploading a staged
+	// file) once the convert attempt has finished. finalize receives the
+	// convert error (nil on success) so it can skip committing a failed
+	// or partial write.
+	Target(ctx context.Context) (spec string, finalize func(convertErr error) error, err error)
+}
+
+// FileTransport addresses a plain local file path.
+type FileTransport struct {
+	Path string
+}
+
+func (t FileTransport) Source(ctx context.Context) (string, func(error) error, error) {
+	return t.Path, func(error) error { return nil }, nil
+}
+
+func (t FileTransport) Target(ctx context.Context) (string, func(error) error, error) {
+	return t.Path, func(error) error { return nil }, nil
+}
+
+// NBDTransport exposes a local file over NBD by spawning 'qemu-nbd', so
+// qemu-img convert can address it as an "nbd://" source or destination
+// without either side needing to share a filesystem.
+type NBDTransport struct {
+	Path       string // Local file to export
+	Format     string // Image format of Path
+	Port       int    // TCP port to listen on; 0 picks a free port
+	Shared     int    // Max simultaneous clients; 0 means qemu-nbd's default (1)
+	Persistent bool   // Keep qemu-nbd running across client disconnects
+
+	cmd *exec.Cmd
+}
+
+func (t *NBDTransport) spec() string {
+	return fmt.Sprintf("nbd://127.0.0.1:%d", t.Port)
+}
+
+func (t *NBDTransport) start(ctx context.Context) (string, func(error) error, error) {
+	if t.Port == 0 {
+		port, err := freeTCPPort()
+		if err != nil {
+			return "", nil, fmt.Errorf("allocating nbd port: %w", err)
+		}
+		t.Port = port
+	}
+
+	args := []string{"--port", strconv.Itoa(t.Port), "--format", t.Format}
+	if t.Shared > 0 {
+		args = append(args, "--shared", strconv.Itoa(t.Shared))
+	}
+	if t.Persistent {
+		args = append(args, "--persistent")
+	}
+	args = append(args, t.Path)
+
+	cmd := exec.CommandContext(ctx, "qemu-nbd", args...)
+	if err := cmd.Start(); err != nil {
+		return "", nil, fmt.Errorf("starting qemu-nbd: %w", err)
+	}
+	t.cmd = cmd
+
+	return t.spec(), func(error) error {
+		if t.cmd.Process == nil {
+			return nil
+		}
+		return t.cmd.Process.Kill()
+	}, nil
+}
+
+func (t *NBDTransport) Source(ctx context.Context) (string, func(error) error, error) {
+	return t.start(ctx)
+}
+
+func (t *NBDTransport) Target(ctx context.Context) (string, func(error) error, error) {
+	return t.start(ctx)
+}
+
+func freeTCPPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// HTTPTransport addresses a remote image over HTTP(S) using qemu-img's
+// built-in curl block driver. It is read-only: Target returns an error,
+// since qemu-img cannot upload a converted image over plain HTTP(S).
+type HTTPTransport struct {
+	URL string
+}
+
+func (t HTTPTransport) Source(ctx context.Context) (string, func(error) error, error) {
+	if _, err := url.Parse(t.URL); err != nil {
+		return "", nil, fmt.Errorf("invalid http(s) url %q: %w", t.URL, err)
+	}
+	return t.URL, func(error) error { return nil }, nil
+}
+
+func (t HTTPTransport) Target(ctx context.Context) (string, func(error) error, error) {
+	return "", nil, fmt.Errorf("http(s) transport does not support writing, qemu-img has no http upload driver")
+}
+
+// S3Downloader fetches an object from S3-compatible storage into w.
+type S3Downloader interface {
+	Download(ctx context.Context, bucket, key string, w io.WriterAt) error
+}
+
+// S3Uploader pushes r to an object in S3-compatible storage.
+type S3Uploader interface {
+	Upload(ctx context.Context, bucket, key string, r io.Reader) error
+}
+
+// S3Transport addresses an object in S3-compatible storage. qemu-img has
+// no native S3 driver, so the object is streamed through a Go S3 client
+// into a local staging file first (Source), or staged locally and
+// uploaded once qemu-img has written to it (Target).
+type S3Transport struct {
+	Bucket     string
+	Key        string
+	StagingDir string // os.TempDir() when empty
+	Downloader S3Downloader
+	Uploader   S3Uploader
+}
+
+func (t S3Transport) stagingPath() string {
+	dir := t.StagingDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	name := strings.ReplaceAll(strings.Trim(t.Key, "/"), "/", "_")
+	return fmt.Sprintf("%s/%s-%s", dir, t.Bucket, name)
+}
+
+func (t S3Transport) Source(ctx context.Context) (string, func(error) error, error) {
+	if t.Downloader == nil {
+		return "", nil, fmt.Errorf("s3 transport: no Downloader configured")
+	}
+
+	path := t.stagingPath()
+	f, err := os.Create(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("creating s3 staging file: %w", err)
+	}
+	defer f.Close()
+
+	if err := t.Downloader.Download(ctx, t.Bucket, t.Key, f); err != nil {
+		os.Remove(path)
+		return "", nil, fmt.Errorf("downloading s3://%s/%s: %w", t.Bucket, t.Key, err)
+	}
+
+	return path, func(error) error { return os.Remove(path) }, nil
+}
+
+// Target stages convert's output locally and, only once convert has
+// reported success, uploads the staged file to S3. A failed or partial
+// convert leaves the staging file on disk to be removed, never uploaded.
+func (t S3Transport) Target(ctx context.Context) (string, func(error) error, error) {
+	if t.Uploader == nil {
+		return "", nil, fmt.Errorf("s3 transport: no Uploader configured")
+	}
+
+	path := t.stagingPath()
+
+	return path, func(convertErr error) error {
+		defer os.Remove(path)
+
+		if convertErr != nil {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("reopening s3 staging file: %w", err)
+		}
+		defer f.Close()
+
+		if err := t.Uploader.Upload(ctx, t.Bucket, t.Key, f); err != nil {
+			return fmt.Errorf("uploading s3://%s/%s: %w", t.Bucket, t.Key, err)
+		}
+
+		return nil
+	}, nil
+}
+
+// ExportTo converts the image to format and writes it to t. t's write is
+// only finalized (e.g. an S3Transport upload) once convert has reported
+// success; finalize still runs on failure so transports can tear down
+// resources (e.g. an NBDTransport's qemu-nbd process), but skips
+// committing a failed or partial conversion.
+func (i Image) ExportTo(ctx context.Context, t Transport, format string) error {
+	spec, finalize, err := t.Target(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, convertErr := runQemuImgContext(ctx, "qemu-img convert", i.Path, "convert", "-O", format, i.Path, spec)
+
+	if finalizeErr := finalize(convertErr); convertErr == nil && finalizeErr != nil {
+		return finalizeErr
+	}
+
+	return convertErr
+}
+
+// ImportFrom converts image data read from t, in the given format, into
+// the image at i.Path. See ExportTo for how convertErr affects finalize.
+func (i Image) ImportFrom(ctx context.Context, t Transport, format string) error {
+	spec, finalize, err := t.Source(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, convertErr := runQemuImgContext(ctx, "qemu-img convert", i.Path, "convert", "-f", format, "-O", i.Format, spec, i.Path)
+
+	if finalizeErr := finalize(convertErr); convertErr == nil && finalizeErr != nil {
+		return finalizeErr
+	}
+
+	return convertErr
+}
+
+// ConvertOptions tunes the behavior of Image.ConvertTo.
+type ConvertOptions struct {
+	Compress   bool // -c, compress the target image
+	Progress   bool // -p, print progress to the qemu-img process's stderr
+	Coroutines int  // -m, number of parallel coroutines to use; 0 means qemu-img's default
+}
+
+// ConvertTo converts the image to newPath in newFormat via
+// 'qemu-img convert', returning an Image describing the result.
+// Encrypted sources are opened via --image-opts (so the source can
+// actually be decrypted on read) and re-encrypted on the target via
+// --target-image-opts, using the same secret, rather than being silently
+// written out in the clear.
+func (i Image) ConvertTo(newPath, newFormat string, opts ConvertOptions) (Image, error) {
+	args := []string{"convert", "-O", newFormat}
+
+	if opts.Compress {
+		args = append(args, "-c")
+	}
+	if opts.Progress {
+		args = append(args, "-p")
+	}
+	if opts.Coroutines > 0 {
+		args = append(args, "-m", strconv.Itoa(opts.Coroutines))
+	}
+
+	newImg := i
+	newImg.Path = newPath
+	newImg.Format = newFormat
+
+	if i.Encrypted {
+		args = append(args, "--object", "secret,id=sec0,data="+i.Secret)
+
+		args = append(args, "--image-opts")
+		args = append(args, fmt.Sprintf(
+			"driver=%s,file.filename=%s,encrypt.format=%s,encrypt.key-secret=sec0",
+			i.Format, i.Path, CipherFormatLUKS,
+		))
+
+		args = append(args, "--target-image-opts")
+		args = append(args, fmt.Sprintf(
+			"driver=%s,file.filename=%s,encrypt.format=%s,encrypt.key-secret=sec0",
+			newFormat, newPath, CipherFormatLUKS,
+		))
+	} else {
+		args = append(args, i.Path, newPath)
+	}
+
+	if _, err := runQemuImgContext(context.Background(), "qemu-img convert", i.Path, args...); err != nil {
+		return Image{}, err
+	}
+
+	return newImg, nil
+}